@@ -0,0 +1,341 @@
+// Copyright 2017 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statistics
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+
+	"github.com/juju/errors"
+	"github.com/pingcap/tidb/context"
+	"github.com/pingcap/tidb/util/sqlexec"
+)
+
+const (
+	// cmSketchDepth is the default number of hash functions (rows) a CMSketch uses.
+	cmSketchDepth = 5
+	// cmSketchWidth is the default number of counters per row.
+	cmSketchWidth = 2048
+	// cmSketchTopN is the default number of heavy hitters tracked exactly alongside the sketch.
+	cmSketchTopN = 20
+	// cmSketchPrime is a prime larger than any value an a_i/b_i/hash can take, used to keep
+	// the h_i(v) = ((a_i*x + b_i) mod p) mod w family pairwise independent.
+	cmSketchPrime = 4294967311 // smallest prime greater than 1<<32
+
+	// twoPow64ModP is 2^64 mod cmSketchPrime, precomputed so rowIndex can reduce a
+	// 128-bit product with plain uint64 arithmetic instead of math/big. Since
+	// cmSketchPrime = 2^32+15, 2^32 ≡ -15 (mod p) and 2^64 ≡ (-15)^2 = 225 (mod p).
+	twoPow64ModP = 225
+)
+
+// CMSketch is a Count-Min Sketch, used to estimate the occurrence count of a
+// value without storing every value seen. A histogram alone loses per-value
+// frequency information inside a bucket, which misestimates equality and IN
+// predicates on skewed data; CMSketch recovers that information at the cost
+// of a small, bounded over-estimate. The sketch additionally tracks the
+// cmSketchTopN heaviest hitters in a top-N heap, whose counts are exact for
+// values tracked since their first occurrence and never below the true count
+// for values that entered the heap by evicting another.
+type CMSketch struct {
+	depth int32
+	width int32
+	count uint64
+	// table[i][j] is the counter for hash row i, bucket j.
+	table [][]uint32
+	// a and b are the per-row multiplier/offset of h_i(x) = ((a[i]*x + b[i]) mod p) mod w.
+	a, b []uint32
+	topN *topNHeap
+}
+
+// NewCMSketch creates a CMSketch with d rows and w counters per row. Larger d
+// lowers the failure probability delta = e^-d; larger w lowers the error
+// bound epsilon = e/w. Its hash seeds are derived deterministically from d
+// (see hashSeeds) rather than drawn at random, so two CMSketches built
+// independently - e.g. from separate analyze samples - always share the same
+// hash family and can be combined with MergeCMSketch.
+func NewCMSketch(d, w int32) *CMSketch {
+	table := make([][]uint32, d)
+	for i := range table {
+		table[i] = make([]uint32, w)
+	}
+	a, b := hashSeeds(d)
+	return &CMSketch{
+		depth: d,
+		width: w,
+		table: table,
+		a:     a,
+		b:     b,
+		topN:  newTopNHeap(cmSketchTopN),
+	}
+}
+
+// hashSeeds deterministically derives the a_i/b_i pairs for a depth-d hash
+// family using a fixed-seed linear congruential generator, so the family
+// depends only on d and not on process start time or call order.
+func hashSeeds(d int32) (a, b []uint32) {
+	a = make([]uint32, d)
+	b = make([]uint32, d)
+	state := uint64(0x9e3779b97f4a7c15)
+	next := func() uint32 {
+		state = state*6364136223846793005 + 1442695040888963407
+		return uint32(state >> 33)
+	}
+	for i := range a {
+		// a must be non-zero mod p for h_i to stay pairwise independent.
+		a[i] = next()%math.MaxUint32 + 1
+		b[i] = uint32(uint64(next()) % cmSketchPrime)
+	}
+	return a, b
+}
+
+// NewDefaultCMSketch creates a CMSketch using the package's default depth,
+// width and top-N heavy hitter count.
+func NewDefaultCMSketch() *CMSketch {
+	return NewCMSketch(cmSketchDepth, cmSketchWidth)
+}
+
+// hash64 folds an arbitrary byte string down to a single uint64 so it can be
+// fed through the h_i(x) = ((a_i*x + b_i) mod p) mod w family. It is not
+// required to be cryptographically strong, only to spread similar inputs
+// apart.
+func hash64(bytes []byte) uint64 {
+	var h uint64 = 14695981039346656037 // FNV-1a offset basis
+	for _, c := range bytes {
+		h ^= uint64(c)
+		h *= 1099511628211 // FNV-1a prime
+	}
+	// FNV-1a alone leaves the high bits nearly unchanged for inputs that
+	// differ only in their last bytes; the MurmurHash3 fmix64 finalizer makes
+	// every output bit depend on every input byte.
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// rowIndex computes h_row(x) = ((a[row]*x + b[row]) mod p) mod width. x can be
+// any uint64, so a[row]*x is computed as a full 128-bit product via
+// bits.Mul64 and reduced mod p piecewise (hi*2^64 + lo, with 2^64 mod p
+// precomputed as twoPow64ModP) rather than overflowing a plain uint64
+// multiply.
+func (c *CMSketch) rowIndex(row int, x uint64) uint32 {
+	xModP := x % uint64(cmSketchPrime)
+	hi, lo := bits.Mul64(uint64(c.a[row]), xModP)
+	h := (hi*twoPow64ModP + lo%uint64(cmSketchPrime)) % uint64(cmSketchPrime)
+	h = (h + uint64(c.b[row])) % uint64(cmSketchPrime)
+	return uint32(h % uint64(c.width))
+}
+
+// InsertBytes adds freq occurrences of the value encoded in bytes to the sketch.
+func (c *CMSketch) InsertBytes(bytes []byte, freq uint64) {
+	c.count += freq
+	x := hash64(bytes)
+	for i := range c.table {
+		j := c.rowIndex(i, x)
+		c.table[i][j] += uint32(freq)
+	}
+	c.topN.Update(bytes, freq)
+}
+
+// QueryBytes returns the estimated number of occurrences of the value
+// encoded in bytes. Heavy hitters tracked by the top-N heap return the heap's
+// count instead of the sketch's (upper-bound biased) estimate; that count is
+// exact unless the value entered the heap by evicting another one.
+func (c *CMSketch) QueryBytes(bytes []byte) uint64 {
+	if cnt, ok := c.topN.Query(bytes); ok {
+		return cnt
+	}
+	x := hash64(bytes)
+	min := uint32(math.MaxUint32)
+	for i := range c.table {
+		j := c.rowIndex(i, x)
+		if c.table[i][j] < min {
+			min = c.table[i][j]
+		}
+	}
+	return uint64(min)
+}
+
+// TotalCount returns the total number of values inserted into the sketch.
+func (c *CMSketch) TotalCount() uint64 {
+	return c.count
+}
+
+// MergeCMSketch merges rc into c, used to combine sketches built from
+// separate analyze samples during an incremental or distributed analyze.
+// Both sketches must share the same hash family (depth, width, a and b).
+func (c *CMSketch) MergeCMSketch(rc *CMSketch) error {
+	if c.depth != rc.depth || c.width != rc.width {
+		return errors.New("cmsketch: cannot merge sketches of different dimensions")
+	}
+	for i := range c.a {
+		if c.a[i] != rc.a[i] || c.b[i] != rc.b[i] {
+			return errors.New("cmsketch: cannot merge sketches built with different hash seeds")
+		}
+	}
+	c.count += rc.count
+	for i := range c.table {
+		for j := range c.table[i] {
+			c.table[i][j] += rc.table[i][j]
+		}
+	}
+	c.topN.Merge(rc.topN)
+	return nil
+}
+
+// encode serializes the sketch's hash seeds, counter table and top-N heavy
+// hitters into a byte blob for storage in mysql.stats_cm_sketch. depth and
+// width are stored as separate columns alongside the blob. The top-N entries
+// are appended the same way encodeMCVGroup serializes its heap, so a reload
+// via decodeCMSketch keeps returning their exact counts instead of falling
+// back to the (necessarily lossy) sketch estimate.
+func (c *CMSketch) encode() ([]byte, error) {
+	d, w := int(c.depth), int(c.width)
+	fixed := make([]byte, 8*d+4*d*w)
+	pos := 0
+	for i := 0; i < d; i++ {
+		binary.BigEndian.PutUint32(fixed[pos:], c.a[i])
+		pos += 4
+		binary.BigEndian.PutUint32(fixed[pos:], c.b[i])
+		pos += 4
+	}
+	for i := 0; i < d; i++ {
+		for j := 0; j < w; j++ {
+			binary.BigEndian.PutUint32(fixed[pos:], c.table[i][j])
+			pos += 4
+		}
+	}
+	var buf bytes.Buffer
+	buf.Write(fixed)
+	if err := writeUint32(&buf, uint32(c.topN.Len())); err != nil {
+		return nil, errors.Trace(err)
+	}
+	for _, e := range c.topN.items {
+		if err := writeUint32(&buf, uint32(len(e.data))); err != nil {
+			return nil, errors.Trace(err)
+		}
+		buf.Write(e.data)
+		if err := writeUint64(&buf, e.count); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeCMSketch rebuilds a CMSketch from a blob previously produced by
+// encode, given the depth/width it was built with. Blobs written before the
+// top-N heap was serialized are exactly the fixed-size prefix with nothing
+// after it, so decoding them yields an empty (but still valid) top-N heap.
+func decodeCMSketch(data []byte, depth, width int32) (*CMSketch, error) {
+	d, w := int(depth), int(width)
+	expected := 8*d + 4*d*w
+	if len(data) < expected {
+		return nil, errors.Errorf("cmsketch: corrupted data, expect at least %d bytes, got %d", expected, len(data))
+	}
+	c := &CMSketch{
+		depth: depth,
+		width: width,
+		a:     make([]uint32, d),
+		b:     make([]uint32, d),
+		table: make([][]uint32, d),
+		topN:  newTopNHeap(cmSketchTopN),
+	}
+	pos := 0
+	for i := 0; i < d; i++ {
+		c.a[i] = binary.BigEndian.Uint32(data[pos:])
+		pos += 4
+		c.b[i] = binary.BigEndian.Uint32(data[pos:])
+		pos += 4
+	}
+	for i := 0; i < d; i++ {
+		c.table[i] = make([]uint32, w)
+		for j := 0; j < w; j++ {
+			c.table[i][j] = binary.BigEndian.Uint32(data[pos:])
+			pos += 4
+			if i == 0 {
+				c.count += uint64(c.table[i][j])
+			}
+		}
+	}
+	if pos < len(data) {
+		r := bytes.NewReader(data[pos:])
+		n, err := readUint32(r)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		for i := uint32(0); i < n; i++ {
+			l, err1 := readUint32(r)
+			if err1 != nil {
+				return nil, errors.Trace(err1)
+			}
+			encoded := make([]byte, l)
+			if _, err1 = io.ReadFull(r, encoded); err1 != nil {
+				return nil, errors.Trace(err1)
+			}
+			count, err1 := readUint64(r)
+			if err1 != nil {
+				return nil, errors.Trace(err1)
+			}
+			c.topN.Update(encoded, count)
+		}
+	}
+	return c, nil
+}
+
+// saveCMSketchToStorage persists cms to mysql.stats_cm_sketch, keyed by the
+// same (table_id, is_index, hist_id) triple as the owning histogram. A nil
+// cms is a no-op, so columns/indices analyzed without a sketch behave as
+// before.
+func saveCMSketchToStorage(ctx context.Context, tableID int64, isIndex int, histID int64, cms *CMSketch) error {
+	if cms == nil {
+		return nil
+	}
+	data, err := cms.encode()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	insertSQL := fmt.Sprintf("insert into mysql.stats_cm_sketch (table_id, is_index, hist_id, depth, width, data) values (%d, %d, %d, %d, %d, X'%X')",
+		tableID, isIndex, histID, cms.depth, cms.width, data)
+	_, err = ctx.(sqlexec.SQLExecutor).Execute(insertSQL)
+	return errors.Trace(err)
+}
+
+// cmSketchFromStorage reads the CMSketch for (table_id, is_index, hist_id)
+// from mysql.stats_cm_sketch, returning a nil sketch (not an error) when the
+// table was analyzed before this feature existed.
+func cmSketchFromStorage(ctx context.Context, tableID int64, isIndex int, histID int64) (*CMSketch, error) {
+	selSQL := fmt.Sprintf("select depth, width, data from mysql.stats_cm_sketch where table_id = %d and is_index = %d and hist_id = %d",
+		tableID, isIndex, histID)
+	rows, _, err := ctx.(sqlexec.RestrictedSQLExecutor).ExecRestrictedSQL(ctx, selSQL)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	depth := rows[0].Data[0].GetInt64()
+	width := rows[0].Data[1].GetInt64()
+	data := rows[0].Data[2].GetBytes()
+	cms, err := decodeCMSketch(data, int32(depth), int32(width))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return cms, nil
+}
@@ -0,0 +1,168 @@
+// Copyright 2017 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statistics
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestCMSketchRowIndexIndependence(t *testing.T) {
+	c := NewCMSketch(cmSketchDepth, cmSketchWidth)
+	x := hash64([]byte("some-value"))
+	seen := make(map[uint32]int)
+	for i := range c.table {
+		seen[c.rowIndex(i, x)]++
+	}
+	// With d=5 rows of width 2048 it is vanishingly unlikely (but not
+	// impossible) that every row lands on the exact same bucket for an
+	// arbitrary value; this is a smoke test that rows don't collapse to one
+	// fixed formula.
+	if len(seen) == 1 && len(c.table) > 1 {
+		t.Fatalf("all rows hashed value to the same bucket, hash family is degenerate")
+	}
+}
+
+func TestCMSketchQueryAfterInsert(t *testing.T) {
+	c := NewCMSketch(cmSketchDepth, cmSketchWidth)
+	for i := 0; i < 1000; i++ {
+		c.InsertBytes([]byte(fmt.Sprintf("key-%d", i%50)), 1)
+	}
+	for i := 0; i < 50; i++ {
+		got := c.QueryBytes([]byte(fmt.Sprintf("key-%d", i)))
+		if got < 20 {
+			t.Fatalf("expected roughly 20 occurrences of key-%d, got %d", i, got)
+		}
+	}
+}
+
+func TestCMSketchHeavyHitterIsExact(t *testing.T) {
+	c := NewCMSketch(cmSketchDepth, cmSketchWidth)
+	for i := 0; i < 10000; i++ {
+		c.InsertBytes([]byte("heavy"), 1)
+	}
+	for i := 0; i < 5000; i++ {
+		c.InsertBytes([]byte(fmt.Sprintf("noise-%d", i)), 1)
+	}
+	if got := c.QueryBytes([]byte("heavy")); got != 10000 {
+		t.Fatalf("heavy hitter should be tracked exactly, want 10000, got %d", got)
+	}
+}
+
+func TestCMSketchErrorBound(t *testing.T) {
+	c := NewCMSketch(cmSketchDepth, cmSketchWidth)
+	const total = 20000
+	for i := 0; i < total; i++ {
+		c.InsertBytes([]byte(fmt.Sprintf("v-%d", i)), 1)
+	}
+	epsilon := math.E / float64(cmSketchWidth)
+	limit := uint64(1 + epsilon*float64(total))
+	for i := 0; i < 200; i++ {
+		got := c.QueryBytes([]byte(fmt.Sprintf("v-%d", i)))
+		// Each value appears exactly once, so any estimate above
+		// 1 + epsilon*total would violate the Count-Min error bound.
+		if got > limit {
+			t.Fatalf("estimate %d exceeds CMSketch error bound %d", got, limit)
+		}
+	}
+}
+
+func TestCMSketchMerge(t *testing.T) {
+	// Independently constructed sketches of the same depth/width share a
+	// hash family by construction, as they would when built from separate
+	// analyze samples.
+	c1 := NewCMSketch(cmSketchDepth, cmSketchWidth)
+	c2 := NewCMSketch(cmSketchDepth, cmSketchWidth)
+
+	for i := 0; i < 100; i++ {
+		c1.InsertBytes([]byte("shared"), 1)
+	}
+	for i := 0; i < 50; i++ {
+		c2.InsertBytes([]byte("shared"), 1)
+	}
+	if err := c1.MergeCMSketch(c2); err != nil {
+		t.Fatalf("unexpected merge error: %v", err)
+	}
+	if got := c1.QueryBytes([]byte("shared")); got != 150 {
+		t.Fatalf("expected merged count 150, got %d", got)
+	}
+	if c1.TotalCount() != 150 {
+		t.Fatalf("expected total count 150, got %d", c1.TotalCount())
+	}
+}
+
+func TestCMSketchMergeDimensionMismatch(t *testing.T) {
+	c1 := NewCMSketch(cmSketchDepth, cmSketchWidth)
+	c2 := NewCMSketch(cmSketchDepth, cmSketchWidth/2)
+	if err := c1.MergeCMSketch(c2); err == nil {
+		t.Fatalf("expected an error merging sketches with different widths")
+	}
+}
+
+func TestCMSketchMergeSeedMismatch(t *testing.T) {
+	c1 := NewCMSketch(cmSketchDepth, cmSketchWidth)
+	c2 := NewCMSketch(cmSketchDepth, cmSketchWidth)
+	c2.a[0]++ // simulate a sketch decoded with a different hash family
+	if err := c1.MergeCMSketch(c2); err == nil {
+		t.Fatalf("expected an error merging sketches built with different hash seeds")
+	}
+}
+
+func TestCMSketchEncodeDecode(t *testing.T) {
+	c := NewCMSketch(cmSketchDepth, cmSketchWidth)
+	for i := 0; i < 500; i++ {
+		c.InsertBytes([]byte(fmt.Sprintf("item-%d", i%30)), 1)
+	}
+	data, err := c.encode()
+	if err != nil {
+		t.Fatalf("unexpected encode error: %v", err)
+	}
+	decoded, err := decodeCMSketch(data, c.depth, c.width)
+	if err != nil {
+		t.Fatalf("unexpected decode error: %v", err)
+	}
+	for i := 0; i < 30; i++ {
+		key := []byte(fmt.Sprintf("item-%d", i))
+		// It must still be at least the true count, whether or not this
+		// particular key's combination survived in the top-N heap.
+		if got := decoded.QueryBytes(key); got < uint64(500/30) {
+			t.Fatalf("decoded sketch underestimates %s: got %d", key, got)
+		}
+	}
+}
+
+func TestCMSketchEncodeDecodePreservesHeavyHitter(t *testing.T) {
+	c := NewCMSketch(cmSketchDepth, cmSketchWidth)
+	for i := 0; i < 10000; i++ {
+		c.InsertBytes([]byte("heavy"), 1)
+	}
+	for i := 0; i < 5000; i++ {
+		c.InsertBytes([]byte(fmt.Sprintf("noise-%d", i)), 1)
+	}
+	data, err := c.encode()
+	if err != nil {
+		t.Fatalf("unexpected encode error: %v", err)
+	}
+	decoded, err := decodeCMSketch(data, c.depth, c.width)
+	if err != nil {
+		t.Fatalf("unexpected decode error: %v", err)
+	}
+	// The top-N heap must round-trip through encode/decode, or every sketch
+	// reloaded from storage (the only path queries actually take) would lose
+	// its exact heavy-hitter counts and fall back to the lossy estimate.
+	if got := decoded.QueryBytes([]byte("heavy")); got != 10000 {
+		t.Fatalf("heavy hitter should still be tracked exactly after a reload, want 10000, got %d", got)
+	}
+}
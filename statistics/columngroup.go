@@ -0,0 +1,352 @@
+// Copyright 2017 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statistics
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/pingcap/tidb/context"
+	"github.com/pingcap/tidb/sessionctx/variable"
+	"github.com/pingcap/tidb/util/codec"
+	"github.com/pingcap/tidb/util/sqlexec"
+	"github.com/pingcap/tidb/util/types"
+)
+
+// mcvGroupTopN is the default number of most-common value combinations kept
+// exactly for a declared column group.
+const mcvGroupTopN = 20
+
+// MCVGroup holds multi-column statistics for a declared group of columns
+// (see `ANALYZE TABLE t COLUMN GROUP (a, b)`): the most common value
+// combinations with their exact counts, plus a HyperLogLog-derived NDV for
+// the group so combinations that miss the MCV list can still be estimated
+// from "everything else" rather than collapsing by a flat 1/100 per column.
+// The exact combinations are tracked with the same bounded min-heap
+// CMSketch uses for its per-value heavy hitters.
+type MCVGroup struct {
+	ColIDs []int64
+	NDV    int64
+
+	// sampleCount is the number of rows Insert was called with, i.e. the size
+	// of the ANALYZE sample the group was built from. Row-count estimates
+	// must be scaled from this sample size up to the table's actual row
+	// count, the same way CMSketch-based estimates are.
+	sampleCount int64
+
+	mcv *topNHeap
+	hll *HyperLogLog
+}
+
+// columnGroupKey canonicalizes a column ID slice into the map key used by
+// Table.ColumnGroups, so lookups don't care whether the caller built the
+// slice itself or copied it from model.IndexInfo.
+func columnGroupKey(colIDs []int64) string {
+	parts := make([]string, len(colIDs))
+	for i, id := range colIDs {
+		parts[i] = strconv.FormatInt(id, 10)
+	}
+	return strings.Join(parts, ",")
+}
+
+// NewMCVGroup creates an empty MCVGroup for colIDs, ready to have sampled
+// rows fed into it via Insert.
+func NewMCVGroup(colIDs []int64) *MCVGroup {
+	return &MCVGroup{
+		ColIDs: append([]int64(nil), colIDs...),
+		mcv:    newTopNHeap(mcvGroupTopN),
+		hll:    NewHyperLogLog(),
+	}
+}
+
+// encodeValues concatenates the codec encoding of each value in a
+// combination into a single comparable key.
+func encodeValues(values []types.Datum) ([]byte, error) {
+	return codec.EncodeValue(nil, values...)
+}
+
+// Insert records one occurrence of the value combination encoded in key,
+// folding it into both the NDV sketch and, if it is frequent enough, the
+// exact top-N list.
+func (g *MCVGroup) Insert(key []byte) {
+	g.sampleCount++
+	g.hll.InsertBytes(key)
+	g.mcv.Update(key, 1)
+}
+
+// finalize computes the group's NDV from its HyperLogLog counter. Call once
+// after all sampled rows have been fed in via Insert.
+func (g *MCVGroup) finalize() {
+	g.NDV = int64(g.hll.Estimate())
+	if n := int64(g.mcv.Len()); g.NDV < n {
+		g.NDV = n
+	}
+}
+
+// queryExact returns the exact count for key if it is one of the group's
+// tracked most-common value combinations.
+func (g *MCVGroup) queryExact(key []byte) (int64, bool) {
+	count, ok := g.mcv.Query(key)
+	return int64(count), ok
+}
+
+// mcvTotalCount sums the exact counts of every tracked combination.
+func (g *MCVGroup) mcvTotalCount() int64 {
+	var total int64
+	for _, e := range g.mcv.items {
+		total += int64(e.count)
+	}
+	return total
+}
+
+// GetRowCountByColumnGroup estimates the row count for an equality predicate
+// over a declared column group: values[i] is the equality value for
+// colIDs[i]. When the combination is one of the group's tracked most-common
+// values, the exact stored count is returned; otherwise the remaining rows
+// are assumed to be spread evenly over the remaining distinct combinations,
+// (count - sum(MCV counts)) / (NDV - len(MCVs)).
+func (t *Table) GetRowCountByColumnGroup(sc *variable.StatementContext, colIDs []int64, values []types.Datum) (float64, bool, error) {
+	group, ok := t.ColumnGroups[columnGroupKey(colIDs)]
+	if !ok {
+		return 0, false, nil
+	}
+	key, err := encodeValues(values)
+	if err != nil {
+		return 0, false, errors.Trace(err)
+	}
+	// The group's counts are in terms of its ANALYZE sample, not the full
+	// table, so every estimate below is scaled by this ratio before it's
+	// comparable to t.Count.
+	scale := 1.0
+	if group.sampleCount > 0 {
+		scale = float64(t.Count) / float64(group.sampleCount)
+	}
+	if exact, ok := group.queryExact(key); ok {
+		return clampRowCount(float64(exact)*scale, t.Count), true, nil
+	}
+	remainingNDV := group.NDV - int64(group.mcv.Len())
+	if remainingNDV <= 0 {
+		// Every distinct combination is already tracked exactly, so a miss
+		// means this value combination simply doesn't occur.
+		return 0, true, nil
+	}
+	remainingCount := float64(group.sampleCount) - float64(group.mcvTotalCount())
+	if remainingCount < 0 {
+		remainingCount = 0
+	}
+	return clampRowCount(remainingCount*scale/float64(remainingNDV), t.Count), true, nil
+}
+
+// indexLeadingColumnIDs returns the column IDs of the leading n columns of
+// idxID, looked up through t.Info so callers can match them against a
+// declared column group without the Index type needing to know its own
+// column identities.
+func (t *Table) indexLeadingColumnIDs(idxID int64, n int) ([]int64, bool) {
+	for _, idxInfo := range t.Info.Indices {
+		if idxInfo.ID != idxID {
+			continue
+		}
+		if len(idxInfo.Columns) < n {
+			return nil, false
+		}
+		colIDs := make([]int64, n)
+		for i := 0; i < n; i++ {
+			offset := idxInfo.Columns[i].Offset
+			if offset < 0 || offset >= len(t.Info.Columns) {
+				return nil, false
+			}
+			colIDs[i] = t.Info.Columns[offset].ID
+		}
+		return colIDs, true
+	}
+	return nil, false
+}
+
+// rowCountByColumnGroupRanges sums the column-group estimate for every range
+// in indexRanges whose first n columns are a pure equality predicate. It
+// returns ok=false (falling back to the index histogram) as soon as a range
+// isn't a pure equality on those columns, or no group covers colIDs.
+func (t *Table) rowCountByColumnGroupRanges(sc *variable.StatementContext, colIDs []int64, indexRanges []*types.IndexRange, n int) (float64, bool, error) {
+	var total float64
+	for _, r := range indexRanges {
+		// Exactly n columns, not just at least n: a range with trailing
+		// predicates (e.g. a=1 AND b=2 AND c>5, where n=2 covers a,b) carries
+		// extra LowVal/HighVal entries that are not pure equalities, and
+		// treating it as an n-column equality would double count rows the
+		// trailing predicate should have filtered out.
+		if len(r.LowVal) != n || len(r.HighVal) != n {
+			return 0, false, nil
+		}
+		values := make([]types.Datum, n)
+		for i := 0; i < n; i++ {
+			cmp, err := r.LowVal[i].CompareDatum(sc, r.HighVal[i])
+			if err != nil {
+				return 0, false, errors.Trace(err)
+			}
+			if cmp != 0 {
+				return 0, false, nil
+			}
+			values[i] = r.LowVal[i]
+		}
+		count, ok, err := t.GetRowCountByColumnGroup(sc, colIDs, values)
+		if err != nil {
+			return 0, false, errors.Trace(err)
+		}
+		if !ok {
+			return 0, false, nil
+		}
+		total += count
+	}
+	return total, true, nil
+}
+
+// saveColumnGroupToStorage persists g to mysql.stats_column_group.
+func saveColumnGroupToStorage(ctx context.Context, tableID int64, g *MCVGroup) error {
+	data, err := encodeMCVGroup(g)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	insertSQL := fmt.Sprintf(
+		"insert into mysql.stats_column_group (table_id, col_ids, ndv, data) values (%d, '%s', %d, X'%X')",
+		tableID, columnGroupKey(g.ColIDs), g.NDV, data)
+	_, err = ctx.(sqlexec.SQLExecutor).Execute(insertSQL)
+	return errors.Trace(err)
+}
+
+// columnGroupsFromStorage loads every declared column group for tableID from
+// mysql.stats_column_group.
+func columnGroupsFromStorage(ctx context.Context, tableID int64) (map[string]*MCVGroup, error) {
+	selSQL := fmt.Sprintf("select col_ids, ndv, data from mysql.stats_column_group where table_id = %d", tableID)
+	rows, _, err := ctx.(sqlexec.RestrictedSQLExecutor).ExecRestrictedSQL(ctx, selSQL)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	groups := make(map[string]*MCVGroup, len(rows))
+	for _, row := range rows {
+		colIDsStr := row.Data[0].GetString()
+		ndv := row.Data[1].GetInt64()
+		data := row.Data[2].GetBytes()
+		colIDs, err1 := parseColumnGroupKey(colIDsStr)
+		if err1 != nil {
+			return nil, errors.Trace(err1)
+		}
+		g, err1 := decodeMCVGroup(colIDs, ndv, data)
+		if err1 != nil {
+			return nil, errors.Trace(err1)
+		}
+		groups[colIDsStr] = g
+	}
+	return groups, nil
+}
+
+func parseColumnGroupKey(key string) ([]int64, error) {
+	parts := strings.Split(key, ",")
+	colIDs := make([]int64, len(parts))
+	for i, p := range parts {
+		id, err := strconv.ParseInt(p, 10, 64)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		colIDs[i] = id
+	}
+	return colIDs, nil
+}
+
+// encodeMCVGroup serializes a group's exact top-N entries; its NDV is stored
+// in its own column rather than in this blob.
+func encodeMCVGroup(g *MCVGroup) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := writeUint64(&buf, uint64(g.sampleCount)); err != nil {
+		return nil, errors.Trace(err)
+	}
+	n := uint32(g.mcv.Len())
+	if err := writeUint32(&buf, n); err != nil {
+		return nil, errors.Trace(err)
+	}
+	for _, e := range g.mcv.items {
+		if err := writeUint32(&buf, uint32(len(e.data))); err != nil {
+			return nil, errors.Trace(err)
+		}
+		buf.Write(e.data)
+		if err := writeUint64(&buf, e.count); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func writeUint32(buf *bytes.Buffer, v uint32) error {
+	var tmp [4]byte
+	binary.BigEndian.PutUint32(tmp[:], v)
+	_, err := buf.Write(tmp[:])
+	return errors.Trace(err)
+}
+
+func writeUint64(buf *bytes.Buffer, v uint64) error {
+	var tmp [8]byte
+	binary.BigEndian.PutUint64(tmp[:], v)
+	_, err := buf.Write(tmp[:])
+	return errors.Trace(err)
+}
+
+func readUint32(r io.Reader) (uint32, error) {
+	var tmp [4]byte
+	if _, err := io.ReadFull(r, tmp[:]); err != nil {
+		return 0, errors.Trace(err)
+	}
+	return binary.BigEndian.Uint32(tmp[:]), nil
+}
+
+func readUint64(r io.Reader) (uint64, error) {
+	var tmp [8]byte
+	if _, err := io.ReadFull(r, tmp[:]); err != nil {
+		return 0, errors.Trace(err)
+	}
+	return binary.BigEndian.Uint64(tmp[:]), nil
+}
+
+func decodeMCVGroup(colIDs []int64, ndv int64, data []byte) (*MCVGroup, error) {
+	g := &MCVGroup{ColIDs: colIDs, NDV: ndv, mcv: newTopNHeap(mcvGroupTopN)}
+	buf := bytes.NewReader(data)
+	sampleCount, err := readUint64(buf)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	g.sampleCount = int64(sampleCount)
+	n, err := readUint32(buf)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	for i := uint32(0); i < n; i++ {
+		l, err1 := readUint32(buf)
+		if err1 != nil {
+			return nil, errors.Trace(err1)
+		}
+		encoded := make([]byte, l)
+		if _, err1 = io.ReadFull(buf, encoded); err1 != nil {
+			return nil, errors.Trace(err1)
+		}
+		count, err1 := readUint64(buf)
+		if err1 != nil {
+			return nil, errors.Trace(err1)
+		}
+		g.mcv.Update(encoded, count)
+	}
+	return g, nil
+}
@@ -0,0 +1,233 @@
+// Copyright 2017 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statistics
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/log"
+	"github.com/pingcap/tidb/context"
+	"github.com/pingcap/tidb/util/sqlexec"
+)
+
+const (
+	// DefaultDeltaFlushInterval is how often a Handle's background flusher
+	// drains accumulated per-table deltas into mysql.stats_meta.
+	DefaultDeltaFlushInterval = 20 * time.Second
+
+	// defaultAutoAnalyzeRatio is the modifyCount/count threshold beyond which
+	// a table is considered stale enough to need a refresh of its histograms.
+	defaultAutoAnalyzeRatio = 0.5
+
+	// maxDeltaFlushRetry bounds the number of CAS retries a single flush of
+	// one table's delta will attempt before giving up for this round; the
+	// delta simply stays queued and is retried on the next tick.
+	maxDeltaFlushRetry = 3
+)
+
+// tableDelta accumulates the insert/update/delete activity seen for one table
+// between flushes. Its fields are only ever touched through sync/atomic, so
+// many sessions can update it concurrently without taking a lock.
+type tableDelta struct {
+	count       int64
+	modifyCount int64
+}
+
+// Handle maintains in-memory statistics state for tables and keeps it in sync
+// with the persisted stats_meta/stats_histograms/stats_buckets tables.
+type Handle struct {
+	// ctx is used to issue the restricted SQL that flushes deltas; it is
+	// owned by the handle and not shared with user sessions.
+	ctx context.Context
+
+	// deltas holds a *tableDelta per table ID that has seen DML since the
+	// last flush. Using sync.Map keeps the common case - many sessions
+	// updating disjoint or overlapping table IDs - free of a single global
+	// lock.
+	deltas sync.Map
+
+	// AutoAnalyzeFunc, when set, is invoked with a table ID after each
+	// successful flush of its delta that leaves its modify ratio above
+	// AutoAnalyzeRatio, so that its histograms can be refreshed. It is injected rather than called directly to avoid a
+	// dependency from statistics onto the executor package that builds
+	// histograms.
+	AutoAnalyzeFunc func(tableID int64)
+
+	// AutoAnalyzeRatio is the modifyCount/count threshold used to decide a
+	// table needs a refresh. Exposed so it can be tuned via a system
+	// variable; defaults to defaultAutoAnalyzeRatio.
+	AutoAnalyzeRatio float64
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewHandle creates a Handle and starts its background delta flusher.
+func NewHandle(ctx context.Context) *Handle {
+	h := &Handle{
+		ctx:              ctx,
+		AutoAnalyzeRatio: defaultAutoAnalyzeRatio,
+		quit:             make(chan struct{}),
+	}
+	h.wg.Add(1)
+	go h.flushLoop()
+	return h
+}
+
+// Close stops the background flusher. It does not flush pending deltas; call
+// FlushDeltas first if that is required.
+func (h *Handle) Close() {
+	close(h.quit)
+	h.wg.Wait()
+}
+
+// UpdateDelta records deltaCount additional rows and modifyCount additional
+// modified rows for tableID, to be folded into stats_meta on the next flush.
+// It is safe to call from many sessions concurrently.
+func (h *Handle) UpdateDelta(tableID int64, deltaCount, modifyCount int64) {
+	v, _ := h.deltas.LoadOrStore(tableID, &tableDelta{})
+	delta := v.(*tableDelta)
+	atomic.AddInt64(&delta.count, deltaCount)
+	atomic.AddInt64(&delta.modifyCount, modifyCount)
+}
+
+func (h *Handle) flushLoop() {
+	defer h.wg.Done()
+	ticker := time.NewTicker(DefaultDeltaFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			h.FlushDeltas()
+		case <-h.quit:
+			return
+		}
+	}
+}
+
+// FlushDeltas drains every accumulated table delta into mysql.stats_meta and
+// fires AutoAnalyzeFunc for tables whose modify ratio has crossed
+// AutoAnalyzeRatio. Failures to flush a given table leave its delta in place
+// so it is retried on the next call.
+func (h *Handle) FlushDeltas() {
+	h.deltas.Range(func(key, value interface{}) bool {
+		tableID := key.(int64)
+		delta := value.(*tableDelta)
+		count := atomic.SwapInt64(&delta.count, 0)
+		modifyCount := atomic.SwapInt64(&delta.modifyCount, 0)
+		if count == 0 && modifyCount == 0 {
+			return true
+		}
+		if err := h.flushTableDelta(tableID, count, modifyCount); err != nil {
+			log.Errorf("flush stats delta for table %d failed: %v", tableID, errors.ErrorStack(err))
+			// Give the delta back so the next tick retries it.
+			atomic.AddInt64(&delta.count, count)
+			atomic.AddInt64(&delta.modifyCount, modifyCount)
+		}
+		return true
+	})
+}
+
+// flushTableDelta applies one table's accumulated delta to stats_meta using
+// optimistic concurrency on the version column, so a flush racing with a
+// concurrent ANALYZE (which rewrites stats_meta wholesale) doesn't clobber
+// either side's work.
+func (h *Handle) flushTableDelta(tableID, count, modifyCount int64) error {
+	exec := h.ctx.(sqlexec.SQLExecutor)
+	for i := 0; i < maxDeltaFlushRetry; i++ {
+		version, curCount, curModifyCount, found, err := h.readTableMeta(tableID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		newVersion := h.ctx.Txn().StartTS()
+		newCount := curCount + count
+		newModifyCount := curModifyCount + modifyCount
+		if !found {
+			// The table has never been analyzed, so there is no row to CAS
+			// against; insert one directly instead of retrying a WHERE
+			// version = 0 update that can never match and would otherwise
+			// exhaust every retry and log a failure on every flush tick.
+			insertSQL := fmt.Sprintf(
+				"insert into mysql.stats_meta (version, table_id, count, modify_count) values (%d, %d, %d, %d)",
+				newVersion, tableID, newCount, newModifyCount)
+			_, err = exec.Execute(insertSQL)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			h.maybeTriggerAutoAnalyze(tableID, newCount, newModifyCount)
+			return nil
+		}
+		updateSQL := fmt.Sprintf(
+			"update mysql.stats_meta set version = %d, count = %d, modify_count = %d where table_id = %d and version = %d",
+			newVersion, newCount, newModifyCount, tableID, version)
+		_, err = exec.Execute(updateSQL)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		affected := h.ctx.GetSessionVars().StmtCtx.AffectedRows()
+		if affected > 0 {
+			h.maybeTriggerAutoAnalyze(tableID, newCount, newModifyCount)
+			return nil
+		}
+		// Another flush or an ANALYZE won the race on version; retry against
+		// the now-current row.
+	}
+	return errors.Errorf("flush stats delta for table %d: too many CAS retries", tableID)
+}
+
+// modifyCountFromStorage reads a table's current modify_count from
+// mysql.stats_meta so it can be attached to a *Table loaded by
+// TableStatsFromStorage.
+func modifyCountFromStorage(ctx context.Context, tableID int64) (int64, error) {
+	selSQL := fmt.Sprintf("select modify_count from mysql.stats_meta where table_id = %d", tableID)
+	rows, _, err := ctx.(sqlexec.RestrictedSQLExecutor).ExecRestrictedSQL(ctx, selSQL)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	if len(rows) == 0 {
+		return 0, nil
+	}
+	return rows[0].Data[0].GetInt64(), nil
+}
+
+func (h *Handle) readTableMeta(tableID int64) (version, count, modifyCount int64, found bool, err error) {
+	selSQL := fmt.Sprintf("select version, count, modify_count from mysql.stats_meta where table_id = %d", tableID)
+	rows, _, err := h.ctx.(sqlexec.RestrictedSQLExecutor).ExecRestrictedSQL(h.ctx, selSQL)
+	if err != nil {
+		return 0, 0, 0, false, errors.Trace(err)
+	}
+	if len(rows) == 0 {
+		return 0, 0, 0, false, nil
+	}
+	return rows[0].Data[0].GetInt64(), rows[0].Data[1].GetInt64(), rows[0].Data[2].GetInt64(), true, nil
+}
+
+// maybeTriggerAutoAnalyze calls AutoAnalyzeFunc once a table's modifyCount to
+// count ratio has crossed AutoAnalyzeRatio.
+func (h *Handle) maybeTriggerAutoAnalyze(tableID, count, modifyCount int64) {
+	if h.AutoAnalyzeFunc == nil || count == 0 {
+		return
+	}
+	ratio := h.AutoAnalyzeRatio
+	if ratio <= 0 {
+		ratio = defaultAutoAnalyzeRatio
+	}
+	if float64(modifyCount)/float64(count) > ratio {
+		h.AutoAnalyzeFunc(tableID)
+	}
+}
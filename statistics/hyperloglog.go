@@ -0,0 +1,140 @@
+// Copyright 2017 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statistics
+
+import (
+	"math"
+	"math/bits"
+
+	"github.com/juju/errors"
+)
+
+const (
+	// hllRegisters is the default number of registers (m) a HyperLogLog
+	// counter uses. With m=2048 the standard error is about 1.04/sqrt(m) ~ 2.3%.
+	hllRegisters = 2048
+
+	// hllRegisterBits is the number of bits used to index into the register
+	// array; 2^hllRegisterBits must equal hllRegisters.
+	hllRegisterBits = 11
+
+	// hllMaxRegisterValue is the largest rank a 6-bit register can hold.
+	hllMaxRegisterValue = 63
+)
+
+// HyperLogLog estimates the number of distinct values (NDV) inserted into it
+// using a fixed, small amount of memory - one 6-bit register per bucket -
+// regardless of how many distinct values are seen. It backs the per-group
+// NDV estimate used by MCVGroup to size the "everything else" bucket when a
+// query misses every tracked most-common-value combination.
+type HyperLogLog struct {
+	// registers[j] holds the largest rank (1 + count of leading zero bits)
+	// seen among values hashing into bucket j.
+	registers []uint8
+}
+
+// NewHyperLogLog creates a HyperLogLog with the package's default register
+// count.
+func NewHyperLogLog() *HyperLogLog {
+	return &HyperLogLog{registers: make([]uint8, hllRegisters)}
+}
+
+// InsertBytes folds the value encoded in bytes into the counter.
+func (h *HyperLogLog) InsertBytes(bytes []byte) {
+	x := hash64(bytes)
+	bucket := x >> (64 - hllRegisterBits)
+	rest := x<<hllRegisterBits | (1 << (hllRegisterBits - 1))
+	rank := uint8(bits.LeadingZeros64(rest) + 1)
+	if rank > hllMaxRegisterValue {
+		rank = hllMaxRegisterValue
+	}
+	if rank > h.registers[bucket] {
+		h.registers[bucket] = rank
+	}
+}
+
+// alpha is the HyperLogLog bias-correction constant for hllRegisters
+// registers (m >= 128, so alpha = 0.7213/(1+1.079/m)).
+func alpha(m float64) float64 {
+	return 0.7213 / (1 + 1.079/m)
+}
+
+// Estimate returns the estimated number of distinct values inserted,
+// applying the standard small-range (linear counting) and large-range
+// corrections around the raw harmonic-mean estimate.
+func (h *HyperLogLog) Estimate() float64 {
+	m := float64(len(h.registers))
+	sum := 0.0
+	zeros := 0
+	for _, r := range h.registers {
+		sum += 1.0 / math.Pow(2, float64(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	raw := alpha(m) * m * m / sum
+
+	switch {
+	case raw <= 2.5*m && zeros > 0:
+		// Small range: the raw estimate is unreliable when many registers are
+		// still empty, so fall back to linear counting.
+		return m * math.Log(m/float64(zeros))
+	case raw <= two32/30:
+		return raw
+	default:
+		// Large range: correct for hash collisions as the 32-bit-equivalent
+		// estimate approaches the birthday bound.
+		return -two32 * math.Log(1-raw/two32)
+	}
+}
+
+// two32 is 2^32, the large-range correction threshold used by the original
+// HyperLogLog paper; we hash to 64 bits but only use hllRegisterBits of index
+// plus the remaining bits for rank, so the classical 2^32 thresholds still
+// apply to the per-register rank distribution.
+const two32 = 1 << 32
+
+// Merge folds rh's registers into h, used to combine per-sample HyperLogLogs
+// built during separate analyze batches. Both counters must share the same
+// register count.
+func (h *HyperLogLog) Merge(rh *HyperLogLog) error {
+	if len(h.registers) != len(rh.registers) {
+		return errors.New("hyperloglog: cannot merge counters with different register counts")
+	}
+	for i, r := range rh.registers {
+		if r > h.registers[i] {
+			h.registers[i] = r
+		}
+	}
+	return nil
+}
+
+// encode serializes the registers to a byte blob for storage, one byte per
+// register; each value is already bounded to 6 bits (0-63).
+func (h *HyperLogLog) encode() []byte {
+	buf := make([]byte, len(h.registers))
+	copy(buf, h.registers)
+	return buf
+}
+
+// decodeHyperLogLog rebuilds a HyperLogLog from a blob previously produced by
+// encode.
+func decodeHyperLogLog(data []byte) (*HyperLogLog, error) {
+	if len(data) != hllRegisters {
+		return nil, errors.Errorf("hyperloglog: corrupted data, expect %d bytes, got %d", hllRegisters, len(data))
+	}
+	registers := make([]uint8, len(data))
+	copy(registers, data)
+	return &HyperLogLog{registers: registers}, nil
+}
@@ -0,0 +1,100 @@
+// Copyright 2017 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statistics
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestHyperLogLogEstimateWithinErrorBound(t *testing.T) {
+	h := NewHyperLogLog()
+	const distinct = 100000
+	for i := 0; i < distinct; i++ {
+		h.InsertBytes([]byte(fmt.Sprintf("value-%d", i)))
+	}
+	est := h.Estimate()
+	// Standard error of a HyperLogLog with m registers is about 1.04/sqrt(m);
+	// allow a generous multiple of that to keep the test stable.
+	stdErr := 1.04 / math.Sqrt(float64(hllRegisters))
+	if math.Abs(est-distinct)/distinct > 5*stdErr {
+		t.Fatalf("estimate %f too far from true NDV %d (allowed relative error %f)", est, distinct, 5*stdErr)
+	}
+}
+
+func TestHyperLogLogMerge(t *testing.T) {
+	h1 := NewHyperLogLog()
+	h2 := NewHyperLogLog()
+	for i := 0; i < 1000; i++ {
+		h1.InsertBytes([]byte(fmt.Sprintf("a-%d", i)))
+	}
+	for i := 0; i < 1000; i++ {
+		h2.InsertBytes([]byte(fmt.Sprintf("b-%d", i)))
+	}
+	if err := h1.Merge(h2); err != nil {
+		t.Fatalf("unexpected merge error: %v", err)
+	}
+	est := h1.Estimate()
+	if est < 1500 || est > 2500 {
+		t.Fatalf("merged estimate %f far from expected ~2000 distinct values", est)
+	}
+}
+
+func TestHyperLogLogMergeDimensionMismatch(t *testing.T) {
+	h1 := &HyperLogLog{registers: make([]uint8, hllRegisters)}
+	h2 := &HyperLogLog{registers: make([]uint8, hllRegisters/2)}
+	if err := h1.Merge(h2); err == nil {
+		t.Fatalf("expected an error merging counters with different register counts")
+	}
+}
+
+func TestHyperLogLogEncodeDecode(t *testing.T) {
+	h := NewHyperLogLog()
+	for i := 0; i < 5000; i++ {
+		h.InsertBytes([]byte(fmt.Sprintf("v-%d", i)))
+	}
+	data := h.encode()
+	decoded, err := decodeHyperLogLog(data)
+	if err != nil {
+		t.Fatalf("unexpected decode error: %v", err)
+	}
+	if decoded.Estimate() != h.Estimate() {
+		t.Fatalf("decoded estimate %f differs from original %f", decoded.Estimate(), h.Estimate())
+	}
+}
+
+func TestMCVGroupExactAndFallbackEstimate(t *testing.T) {
+	g := NewMCVGroup([]int64{1, 2})
+	for i := 0; i < 900; i++ {
+		g.Insert([]byte("hot"))
+	}
+	for i := 0; i < 100; i++ {
+		g.Insert([]byte(fmt.Sprintf("cold-%d", i)))
+	}
+	g.finalize()
+
+	if count, ok := g.queryExact([]byte("hot")); !ok || count != 900 {
+		t.Fatalf("expected exact count 900 for heavy combination, got %d, ok=%v", count, ok)
+	}
+	if g.mcv.Len() > mcvGroupTopN {
+		t.Fatalf("expected at most %d tracked combinations, got %d", mcvGroupTopN, g.mcv.Len())
+	}
+	if g.NDV < int64(g.mcv.Len()) {
+		t.Fatalf("NDV estimate %d should be at least the number of tracked combinations %d", g.NDV, g.mcv.Len())
+	}
+	if _, ok := g.queryExact([]byte("never-inserted")); ok {
+		t.Fatalf("a combination that was never inserted must not be tracked exactly")
+	}
+}
@@ -23,6 +23,7 @@ import (
 	"github.com/pingcap/tidb/context"
 	"github.com/pingcap/tidb/model"
 	"github.com/pingcap/tidb/sessionctx/variable"
+	"github.com/pingcap/tidb/util/codec"
 	"github.com/pingcap/tidb/util/sqlexec"
 	"github.com/pingcap/tidb/util/types"
 )
@@ -46,7 +47,37 @@ type Table struct {
 	Columns map[int64]*Column
 	Indices map[int64]*Index
 	Count   int64 // Total row count in a table.
-	Pseudo  bool
+	// ModifyCount is the number of rows inserted/updated/deleted since the
+	// histograms were last rebuilt by ANALYZE, as tracked by Handle.UpdateDelta.
+	ModifyCount int64
+	// ColumnGroups holds multi-column statistics declared via
+	// `ANALYZE TABLE t COLUMN GROUP (a, b)`, keyed by columnGroupKey(colIDs).
+	ColumnGroups map[string]*MCVGroup
+	Pseudo       bool
+	// AutoAnalyzeRatio is the Handle.AutoAnalyzeRatio in effect when this
+	// Table was loaded, used by staleness blending. Zero means "use the
+	// package default", since a freshly constructed Table (e.g. PseudoTable)
+	// has no Handle to copy it from.
+	AutoAnalyzeRatio float64
+}
+
+// autoAnalyzeRatio returns t.AutoAnalyzeRatio if it was set, falling back to
+// defaultAutoAnalyzeRatio otherwise.
+func (t *Table) autoAnalyzeRatio() float64 {
+	if t.AutoAnalyzeRatio > 0 {
+		return t.AutoAnalyzeRatio
+	}
+	return defaultAutoAnalyzeRatio
+}
+
+// staleness returns how far the table has drifted since its histograms were
+// last rebuilt, expressed as ModifyCount / Count. A table with no rows is
+// never considered stale.
+func (t *Table) staleness() float64 {
+	if t.Count == 0 {
+		return 0
+	}
+	return float64(t.ModifyCount) / float64(t.Count)
 }
 
 // SaveToStorage saves stats table to storage.
@@ -62,7 +93,10 @@ func (h *Handle) SaveToStorage(ctx context.Context, t *Table) error {
 	if err != nil {
 		return errors.Trace(err)
 	}
-	insertSQL := fmt.Sprintf("insert into mysql.stats_meta (version, table_id, count) values (%d, %d, %d)", version, t.Info.ID, t.Count)
+	// A full ANALYZE rebuilds every histogram from scratch, so it resets
+	// modify_count: the drift it was tracking no longer applies to the fresh
+	// histograms.
+	insertSQL := fmt.Sprintf("insert into mysql.stats_meta (version, table_id, count, modify_count) values (%d, %d, %d, 0)", version, t.Info.ID, t.Count)
 	_, err = ctx.(sqlexec.SQLExecutor).Execute(insertSQL)
 	if err != nil {
 		return errors.Trace(err)
@@ -77,17 +111,45 @@ func (h *Handle) SaveToStorage(ctx context.Context, t *Table) error {
 	if err != nil {
 		return errors.Trace(err)
 	}
+	deleteSQL = fmt.Sprintf("delete from mysql.stats_cm_sketch where table_id = %d", t.Info.ID)
+	_, err = ctx.(sqlexec.SQLExecutor).Execute(deleteSQL)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	// Column groups are also (re)saved here so a full ANALYZE doesn't leave
+	// stale groups behind; `ANALYZE TABLE t COLUMN GROUP (a, b)` updates a
+	// single group the same way, by loading the table, refreshing that one
+	// entry in t.ColumnGroups, and calling SaveToStorage again.
+	deleteSQL = fmt.Sprintf("delete from mysql.stats_column_group where table_id = %d", t.Info.ID)
+	_, err = ctx.(sqlexec.SQLExecutor).Execute(deleteSQL)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for _, group := range t.ColumnGroups {
+		err = saveColumnGroupToStorage(ctx, t.Info.ID, group)
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
 	for _, col := range t.Columns {
 		err = col.saveToStorage(ctx, t.Info.ID, 0)
 		if err != nil {
 			return errors.Trace(err)
 		}
+		err = saveCMSketchToStorage(ctx, t.Info.ID, 0, col.ID, col.CMSketch)
+		if err != nil {
+			return errors.Trace(err)
+		}
 	}
 	for _, idx := range t.Indices {
 		err = idx.saveToStorage(ctx, t.Info.ID, 1)
 		if err != nil {
 			return errors.Trace(err)
 		}
+		err = saveCMSketchToStorage(ctx, t.Info.ID, 1, idx.ID, idx.CMSketch)
+		if err != nil {
+			return errors.Trace(err)
+		}
 	}
 	_, err = ctx.(sqlexec.SQLExecutor).Execute("commit")
 	return errors.Trace(err)
@@ -95,11 +157,17 @@ func (h *Handle) SaveToStorage(ctx context.Context, t *Table) error {
 
 // TableStatsFromStorage loads table stats info from storage.
 func (h *Handle) TableStatsFromStorage(ctx context.Context, info *model.TableInfo, count int64) (*Table, error) {
+	modifyCount, err := modifyCountFromStorage(ctx, info.ID)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
 	table := &Table{
-		Info:    info,
-		Count:   count,
-		Columns: make(map[int64]*Column, len(info.Columns)),
-		Indices: make(map[int64]*Index, len(info.Indices)),
+		Info:             info,
+		Count:            count,
+		ModifyCount:      modifyCount,
+		Columns:          make(map[int64]*Column, len(info.Columns)),
+		Indices:          make(map[int64]*Index, len(info.Indices)),
+		AutoAnalyzeRatio: h.AutoAnalyzeRatio,
 	}
 	selSQL := fmt.Sprintf("select table_id, is_index, hist_id, distinct_count from mysql.stats_histograms where table_id = %d", info.ID)
 	rows, _, err := ctx.(sqlexec.RestrictedSQLExecutor).ExecRestrictedSQL(ctx, selSQL)
@@ -122,7 +190,11 @@ func (h *Handle) TableStatsFromStorage(ctx context.Context, info *model.TableInf
 					if err1 != nil {
 						return nil, errors.Trace(err1)
 					}
-					idx = &Index{Histogram: *hg}
+					cms, err1 := cmSketchFromStorage(ctx, info.ID, 1, histID)
+					if err1 != nil {
+						return nil, errors.Trace(err1)
+					}
+					idx = &Index{Histogram: *hg, CMSketch: cms}
 					break
 				}
 			}
@@ -142,7 +214,11 @@ func (h *Handle) TableStatsFromStorage(ctx context.Context, info *model.TableInf
 					if err != nil {
 						return nil, errors.Trace(err)
 					}
-					col = &Column{Histogram: *hg}
+					cms, err1 := cmSketchFromStorage(ctx, info.ID, 0, histID)
+					if err1 != nil {
+						return nil, errors.Trace(err1)
+					}
+					col = &Column{Histogram: *hg, CMSketch: cms}
 					break
 				}
 			}
@@ -160,6 +236,10 @@ func (h *Handle) TableStatsFromStorage(ctx context.Context, info *model.TableInf
 	if columnCount != len(info.Columns) {
 		return nil, errors.New("The number of columns doesn't match with the schema")
 	}
+	table.ColumnGroups, err = columnGroupsFromStorage(ctx, info.ID)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
 	return table, nil
 }
 
@@ -182,28 +262,59 @@ func (t *Table) columnIsInvalid(colInfo *model.ColumnInfo) bool {
 	return !ok
 }
 
+// blendWithPseudo fades a histogram-based estimate towards the pseudo
+// estimate as the table's staleness grows past ratio, so a histogram that
+// DML has outrun degrades gracefully instead of being trusted outright.
+// Below ratio the histogram estimate is returned unchanged; by 2*ratio the
+// pseudo estimate fully takes over.
+func blendWithPseudo(histEstimate, pseudoEstimate, staleness, ratio float64) float64 {
+	if ratio <= 0 || staleness <= ratio {
+		return histEstimate
+	}
+	weight := (staleness - ratio) / ratio
+	if weight > 1 {
+		weight = 1
+	}
+	return histEstimate*(1-weight) + pseudoEstimate*weight
+}
+
 // ColumnGreaterRowCount estimates the row count where the column greater than value.
 func (t *Table) ColumnGreaterRowCount(sc *variable.StatementContext, value types.Datum, colInfo *model.ColumnInfo) (float64, error) {
+	pseudoEstimate := float64(t.Count) / pseudoLessRate
 	if t.columnIsInvalid(colInfo) {
-		return float64(t.Count) / pseudoLessRate, nil
+		return pseudoEstimate, nil
 	}
-	return t.Columns[colInfo.ID].greaterRowCount(sc, value)
+	count, err := t.Columns[colInfo.ID].greaterRowCount(sc, value)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return blendWithPseudo(count, pseudoEstimate, t.staleness(), t.autoAnalyzeRatio()), nil
 }
 
 // ColumnLessRowCount estimates the row count where the column less than value.
 func (t *Table) ColumnLessRowCount(sc *variable.StatementContext, value types.Datum, colInfo *model.ColumnInfo) (float64, error) {
+	pseudoEstimate := float64(t.Count) / pseudoLessRate
 	if t.columnIsInvalid(colInfo) {
-		return float64(t.Count) / pseudoLessRate, nil
+		return pseudoEstimate, nil
+	}
+	count, err := t.Columns[colInfo.ID].lessRowCount(sc, value)
+	if err != nil {
+		return 0, errors.Trace(err)
 	}
-	return t.Columns[colInfo.ID].lessRowCount(sc, value)
+	return blendWithPseudo(count, pseudoEstimate, t.staleness(), t.autoAnalyzeRatio()), nil
 }
 
 // ColumnBetweenRowCount estimates the row count where column greater or equal to a and less than b.
 func (t *Table) ColumnBetweenRowCount(sc *variable.StatementContext, a, b types.Datum, colInfo *model.ColumnInfo) (float64, error) {
+	pseudoEstimate := float64(t.Count) / pseudoBetweenRate
 	if t.columnIsInvalid(colInfo) {
-		return float64(t.Count) / pseudoBetweenRate, nil
+		return pseudoEstimate, nil
+	}
+	count, err := t.Columns[colInfo.ID].betweenRowCount(sc, a, b)
+	if err != nil {
+		return 0, errors.Trace(err)
 	}
-	return t.Columns[colInfo.ID].betweenRowCount(sc, a, b)
+	return blendWithPseudo(count, pseudoEstimate, t.staleness(), t.autoAnalyzeRatio()), nil
 }
 
 // ColumnEqualRowCount estimates the row count where the column equals to value.
@@ -211,7 +322,41 @@ func (t *Table) ColumnEqualRowCount(sc *variable.StatementContext, value types.D
 	if t.columnIsInvalid(colInfo) {
 		return float64(t.Count) / pseudoEqualRate, nil
 	}
-	return t.Columns[colInfo.ID].equalRowCount(sc, value)
+	col := t.Columns[colInfo.ID]
+	pseudoEstimate := float64(t.Count) / pseudoEqualRate
+	if col.CMSketch != nil {
+		bytes, err := codec.EncodeValue(nil, value)
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+		// NullCount is the count of the whole column, not of this value, so
+		// it must not be subtracted from the sketch's per-value estimate.
+		// The sketch was built from ANALYZE's sample, not the full table, so
+		// its raw count must be scaled up to the table's actual row count
+		// before it's comparable to pseudoEstimate or t.Count.
+		estimate := float64(col.CMSketch.QueryBytes(bytes))
+		if sampleCount := col.CMSketch.TotalCount(); sampleCount > 0 {
+			estimate *= float64(t.Count) / float64(sampleCount)
+		}
+		count := clampRowCount(estimate, t.Count)
+		return blendWithPseudo(count, pseudoEstimate, t.staleness(), t.autoAnalyzeRatio()), nil
+	}
+	count, err := col.equalRowCount(sc, value)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return blendWithPseudo(count, pseudoEstimate, t.staleness(), t.autoAnalyzeRatio()), nil
+}
+
+// clampRowCount keeps an estimated row count within the valid [0, total] range.
+func clampRowCount(count float64, total int64) float64 {
+	if count < 0 {
+		return 0
+	}
+	if count > float64(total) {
+		return float64(total)
+	}
+	return count
 }
 
 // GetRowCountByIntColumnRanges estimates the row count by a slice of IntColumnRange.
@@ -229,6 +374,19 @@ func (t *Table) GetRowCountByIndexRanges(sc *variable.StatementContext, idxID in
 	if t.Pseudo || idx == nil || len(idx.Buckets) == 0 {
 		return getPseudoRowCountByIndexRanges(sc, indexRanges, inAndEQCnt, float64(t.Count))
 	}
+	// When the predicate is a pure equality on the leading inAndEQCnt columns
+	// and those columns have a declared joint statistics group, use it
+	// instead of the index histogram - it captures correlation between the
+	// columns that per-column equalRowCount necessarily ignores.
+	if inAndEQCnt > 1 {
+		if colIDs, ok := t.indexLeadingColumnIDs(idxID, inAndEQCnt); ok {
+			if count, ok, err := t.rowCountByColumnGroupRanges(sc, colIDs, indexRanges, inAndEQCnt); err != nil {
+				return 0, errors.Trace(err)
+			} else if ok {
+				return count, nil
+			}
+		}
+	}
 	return idx.getRowCount(sc, indexRanges, inAndEQCnt)
 }
 
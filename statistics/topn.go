@@ -0,0 +1,108 @@
+// Copyright 2017 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statistics
+
+import "container/heap"
+
+// topNMeta is one heavy-hitter entry: the tracked occurrence count of a single
+// value, keyed by its encoded bytes.
+type topNMeta struct {
+	data  []byte
+	count uint64
+}
+
+// topNHeap is a bounded min-heap that keeps the n most frequent values a
+// CMSketch has seen. Values evicted from the heap are only ever visible
+// through the sketch's (necessarily lossy) estimate.
+type topNHeap struct {
+	n     int
+	items []*topNMeta
+	index map[string]int
+}
+
+func newTopNHeap(n int) *topNHeap {
+	return &topNHeap{n: n, index: make(map[string]int)}
+}
+
+// Len, Less, Swap, Push and Pop implement heap.Interface.
+func (h *topNHeap) Len() int { return len(h.items) }
+
+func (h *topNHeap) Less(i, j int) bool { return h.items[i].count < h.items[j].count }
+
+func (h *topNHeap) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+	h.index[string(h.items[i].data)] = i
+	h.index[string(h.items[j].data)] = j
+}
+
+func (h *topNHeap) Push(x interface{}) {
+	meta := x.(*topNMeta)
+	h.index[string(meta.data)] = len(h.items)
+	h.items = append(h.items, meta)
+}
+
+func (h *topNHeap) Pop() interface{} {
+	old := h.items
+	n := len(old)
+	item := old[n-1]
+	h.items = old[:n-1]
+	delete(h.index, string(item.data))
+	return item
+}
+
+// Update records freq additional occurrences of data, keeping the heap
+// bounded to the n most frequent values seen so far.
+func (h *topNHeap) Update(data []byte, freq uint64) {
+	if h.n == 0 {
+		return
+	}
+	if pos, ok := h.index[string(data)]; ok {
+		h.items[pos].count += freq
+		heap.Fix(h, pos)
+		return
+	}
+	if len(h.items) < h.n {
+		heap.Push(h, &topNMeta{data: append([]byte(nil), data...), count: freq})
+		return
+	}
+	// Space-Saving semantics: the incoming value always replaces the minimum
+	// and inherits the evicted entry's count as a floor rather than starting
+	// fresh at freq, so the heap never underestimates a value it has only
+	// recently started tracking.
+	newCount := h.items[0].count + freq
+	delete(h.index, string(h.items[0].data))
+	h.items[0].data = append([]byte(nil), data...)
+	h.items[0].count = newCount
+	h.index[string(h.items[0].data)] = 0
+	heap.Fix(h, 0)
+}
+
+// Query returns the tracked count for data, if it is currently in the heap.
+// The count is exact if data has been tracked since its first occurrence;
+// otherwise it includes the count inherited on eviction and is an upper bound.
+func (h *topNHeap) Query(data []byte) (uint64, bool) {
+	pos, ok := h.index[string(data)]
+	if !ok {
+		return 0, false
+	}
+	return h.items[pos].count, true
+}
+
+// Merge folds rh's entries into h, used when combining sketches built from
+// separate analyze samples.
+func (h *topNHeap) Merge(rh *topNHeap) {
+	for _, item := range rh.items {
+		h.Update(item.data, item.count)
+	}
+}
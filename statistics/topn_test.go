@@ -0,0 +1,37 @@
+// Copyright 2017 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statistics
+
+import "testing"
+
+func TestTopNHeapEvictionKeepsFloor(t *testing.T) {
+	h := newTopNHeap(2)
+	h.Update([]byte("a"), 10)
+	h.Update([]byte("b"), 11)
+	// Evicts "a" (count 10); the incoming value must inherit that count as a
+	// floor instead of starting over at its own freq, or a value that racks
+	// up many small increments just under the heap's floor would be
+	// under-counted every time it displaces the minimum.
+	h.Update([]byte("c"), 1)
+	count, ok := h.Query([]byte("c"))
+	if !ok {
+		t.Fatalf("expected c to be tracked after evicting the minimum")
+	}
+	if count < 11 {
+		t.Fatalf("expected evicted entry's count to carry forward as a floor, got %d", count)
+	}
+	if _, ok := h.Query([]byte("a")); ok {
+		t.Fatalf("a should have been evicted")
+	}
+}